@@ -7,13 +7,16 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/ttacon/chalk"
 	"github.com/urfave/cli/v2"
+	"golang.org/x/tools/go/packages"
 )
 
 var (
@@ -67,12 +70,32 @@ func getGitRangeVal(c *cli.Context, key string, envNames []string) string {
 // actions as they execute.
 type Builder interface {
 	Run() ([]string, error)
+
+	// WorktreeDir returns the path of the temporary worktree checked out
+	// for this build (see ChangesetIdentification.UseWorktree), or "" if
+	// none was used. Only meaningful after Run has returned; by then the
+	// worktree itself has already been removed by Run's cleanups.
+	WorktreeDir() string
 }
 
-// builder is our local implementation of the `Builder` interface, it is a set
-// of ordered `Action`s to take.
+// builder is our local implementation of the `Builder` interface. It holds
+// the action graph (see dagNode) that NewBuilderFromCLI assembles.
 type builder struct {
-	actions []Action
+	nodes []dagNode
+
+	// worktreeDir is the worktree checked out for this run, published by
+	// ChangesetIdentification via workingDirectoryContextKey, if
+	// UseWorktree was set. Populated once Run completes.
+	worktreeDir string
+}
+
+// WorktreeDir returns the path of the temporary worktree checked out for this
+// build, or the empty string if UseWorktree wasn't set or Run aborted before
+// finishing every level. Only meaningful after Run has been called. The
+// worktree is removed (git worktree remove --force) by Run's deferred
+// cleanups, so the path no longer exists once Run has returned.
+func (b *builder) WorktreeDir() string {
+	return b.worktreeDir
 }
 
 // NewBuilderFromCLI creates a builder from a CLI's context.
@@ -82,7 +105,7 @@ func NewBuilderFromCLI(c *cli.Context) Builder {
 		log.Println(warn("this is a dry run, no changes will be made"))
 	}
 
-	var actions []Action
+	var nodes []dagNode
 
 	var workingDir = c.String("working-directory")
 	if len(workingDir) > 0 {
@@ -90,62 +113,247 @@ func NewBuilderFromCLI(c *cli.Context) Builder {
 	}
 
 	// Identify changeset
-	actions = append(actions, &ChangesetIdentification{
-		GitRangeStart:    getGitRangeVal(c, "git-range-start", gitRangeStartEnvvars),
-		GitRangeEnd:      getGitRangeVal(c, "git-range-end", gitRangeEndEnvvars),
-		WorkingDirectory: workingDir,
+	gitRangeStart := getGitRangeVal(c, "git-range-start", gitRangeStartEnvvars)
+	gitRangeEnd := getGitRangeVal(c, "git-range-end", gitRangeEndEnvvars)
+
+	explicitChangesetSource := c.String("changeset-source")
+	changesetSource, sourceErr := changesetSourceFromCLI(
+		explicitChangesetSource, workingDir, gitRangeStart, gitRangeEnd,
+	)
+	if sourceErr != nil {
+		if explicitChangesetSource == "" {
+			// No source was requested, so fall back to a nil Source (which
+			// ChangesetIdentification treats as GitDiffTreeSource) rather
+			// than failing the run.
+			log.Println(warn("failed to resolve changeset source: "), sourceErr)
+			changesetSource, sourceErr = nil, nil
+		} else {
+			// An explicit source was requested and failed to resolve; falling
+			// back to GitDiffTreeSource here would silently reintroduce the
+			// shallow-clone/missing-local-refs failure mode the explicit
+			// source exists to avoid, so surface it as a hard failure instead.
+			sourceErr = fmt.Errorf("failed to resolve explicit changeset source %q: %w", explicitChangesetSource, sourceErr)
+		}
+	}
+
+	nodes = append(nodes, dagNode{
+		name: "changeset",
+		action: &ChangesetIdentification{
+			Source:           changesetSource,
+			GitRangeStart:    gitRangeStart,
+			GitRangeEnd:      gitRangeEnd,
+			WorkingDirectory: workingDir,
+			UseWorktree:      c.Bool("use-worktree"),
+			sourceErr:        sourceErr,
+		},
+		produces: []string{"changes", workingDirectoryContextKey},
 	})
 
 	// Identify artifact entrypoints
-	actions = append(actions, &EntrypointIdentification{
-		Prefix:           c.String("cmd-prefix"),
-		SkipNested:       c.Bool("skip-nested-entrypoints"),
-		WorkingDirectory: workingDir,
+	nodes = append(nodes, dagNode{
+		name: "entrypoints",
+		action: &EntrypointIdentification{
+			Prefix:           c.String("cmd-prefix"),
+			SkipNested:       c.Bool("skip-nested-entrypoints"),
+			WorkingDirectory: workingDir,
+		},
+		dependsOn: []string{"changeset"},
+		produces:  []string{"entrypoints"},
 	})
 
 	// Identify dependencies of entrypoints
-	actions = append(actions, &EntrypointDependencyIdentification{
-		RepoBasename:     c.String("repo-basename"),
-		WorkingDirectory: workingDir,
+	nodes = append(nodes, dagNode{
+		name: "dependencies",
+		action: &EntrypointDependencyIdentification{
+			RepoBasename:     c.String("repo-basename"),
+			WorkingDirectory: workingDir,
+			BuildFlags:       c.StringSlice("build-flag"),
+		},
+		dependsOn: []string{"entrypoints"},
+		produces:  []string{"dependencies"},
 	})
 
 	// Determine targets that must be rebuilt
-	actions = append(actions, ModifiedDependencies{})
+	nodes = append(nodes, dagNode{
+		name:      "modified-dependencies",
+		action:    ModifiedDependencies{},
+		dependsOn: []string{"dependencies"},
+		produces:  []string{"targets"},
+	})
 
 	// Identify any entrypoints that need to be rebuilt
-	actions = append(actions, &OutputDependencies{
-		Format: c.String("out-format"),
+	nodes = append(nodes, dagNode{
+		name: "output-dependencies",
+		action: &OutputDependencies{
+			Format: c.String("out-format"),
+		},
+		dependsOn: []string{"modified-dependencies"},
+		produces:  []string{"rebuilds"},
 	})
 
+	// RebuildTargets only needs the resolved rebuild targets and (if set) a
+	// running builder container; it has no dependency on the Go package
+	// graph, so the container and the entrypoint/dependency chain above are
+	// independent work and run concurrently.
+	rebuildDependsOn := []string{"output-dependencies"}
+
+	// If a builder image was given, start a single long-lived container
+	// that every RebuildTargets subprocess will be `docker exec`'d into,
+	// rather than paying container-startup cost per target.
+	if builderImage := c.String("builder-image"); len(builderImage) > 0 {
+		nodes = append(nodes, dagNode{
+			name: "container-builder",
+			action: &ContainerBuilder{
+				Image:            builderImage,
+				WorkingDirectory: workingDir,
+				Keep:             c.Bool("builder-keep"),
+			},
+			dependsOn: []string{"changeset"},
+			produces:  []string{dockerClientContextKey, dockerContainerContextKey},
+		})
+		rebuildDependsOn = append(rebuildDependsOn, "container-builder")
+	}
+
+	artifactsDir := c.String("artifacts-dir")
+	buildCommand := c.String("build-command")
+
+	persistDependsOn := []string{"rebuild-targets"}
+
+	if len(artifactsDir) > 0 {
+		// Snapshot file mtimes before the build so PersistArtifacts can
+		// later tell which files it actually produced. This only needs the
+		// working directory, so it too runs concurrently with the
+		// entrypoint/dependency chain rather than waiting on it.
+		nodes = append(nodes, dagNode{
+			name: "workspace-snapshot",
+			action: &WorkspaceSnapshot{
+				WorkingDirectory: workingDir,
+			},
+			dependsOn: []string{"changeset"},
+			produces:  []string{workspaceMtimesContextKey},
+		})
+		persistDependsOn = append(persistDependsOn, "workspace-snapshot")
+	}
+
 	// Rebuild these artifacts
-	actions = append(actions, &RebuildTargets{
-		IsDryRun:         isDryRun,
-		BuildCommand:     c.String("build-command"),
-		WorkingDirectory: workingDir,
+	nodes = append(nodes, dagNode{
+		name: "rebuild-targets",
+		action: &RebuildTargets{
+			IsDryRun:         isDryRun,
+			BuildCommand:     buildCommand,
+			WorkingDirectory: workingDir,
+			Jobs:             c.Int("jobs"),
+			FailFast:         c.Bool("fail-fast"),
+			ForceAll:         c.Bool("force-all"),
+		},
+		dependsOn: rebuildDependsOn,
+		produces:  []string{"build-logs"},
 	})
 
-	// TODO(ttacon): add an action for persisting the build logs to disk.
+	// Persist build logs and a machine-readable manifest, as the terminal
+	// action, only when the caller asked for it.
+	if len(artifactsDir) > 0 {
+		nodes = append(nodes, dagNode{
+			name: "persist-artifacts",
+			action: &PersistArtifacts{
+				ArtifactsDir:     artifactsDir,
+				WorkingDirectory: workingDir,
+				BuildCommand:     buildCommand,
+				GitRangeStart:    gitRangeStart,
+				GitRangeEnd:      gitRangeEnd,
+			},
+			dependsOn: persistDependsOn,
+		})
+	}
 
 	return &builder{
-		actions: actions,
+		nodes: nodes,
 	}
 }
 
-// Run runs our actions sequentially, passing a continually evolving context
-// between them.
+// doResult is one node's outcome from a level's concurrent Do pass.
+type doResult struct {
+	node dagNode
+	ctx  context.Context
+	err  error
+}
+
+// Run groups b.nodes into dependency levels (see topoLevels) and runs each
+// level's actions concurrently, merging the context keys they declare via
+// produces back into a shared context before the next level starts. Actions
+// within a level are, by construction, independent of one another (that's
+// what makes them a level); actions in later levels still see every value
+// published by their dependencies.
 func (b *builder) Run() ([]string, error) {
 	ctx := context.TODO()
-	for _, action := range b.actions {
-		if err := action.Precheck(ctx); err != nil {
-			return nil, err
+
+	var cleanups []Cleanuper
+	defer func() { runCleanups(ctx, cleanups) }()
+
+	levels, err := topoLevels(b.nodes)
+	if err != nil {
+		return nil, err
+	}
+
+	// runErr accumulates errors from nodes that still managed to produce a
+	// usable context (see doResult below): we don't want a RebuildTargets
+	// failure to short-circuit the graph before a downstream
+	// PersistArtifacts gets to run, but the failure must still surface once
+	// everything that can run has.
+	var runErr error
+
+	for _, level := range levels {
+		for _, node := range level {
+			if err := node.action.Precheck(ctx); err != nil {
+				return nil, fmt.Errorf("%s: %w", node.name, err)
+			}
+			if cleanuper, ok := node.action.(Cleanuper); ok {
+				cleanups = append(cleanups, cleanuper)
+			}
 		}
 
-		newCtx, err := action.Do(ctx)
-		if err != nil {
-			return nil, err
+		results := make([]doResult, len(level))
+		var wg sync.WaitGroup
+		for i, node := range level {
+			i, node := i, node
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				newCtx, err := node.action.Do(ctx)
+				results[i] = doResult{node: node, ctx: newCtx, err: err}
+			}()
 		}
+		wg.Wait()
+
+		// A node can return both a non-nil context and a non-nil error
+		// (RebuildTargets does this on a build failure) to signal a
+		// partial success: its dependents still have what they need to
+		// run. Only a nil context aborts the whole run, since nothing
+		// downstream can proceed without it.
+		var abort bool
+		for _, res := range results {
+			if res.err != nil {
+				runErr = errors.Join(runErr, fmt.Errorf("%s: %w", res.node.name, res.err))
+			}
+			if res.ctx == nil {
+				abort = true
+				continue
+			}
+			for _, key := range res.node.produces {
+				if val := res.ctx.Value(key); val != nil {
+					ctx = context.WithValue(ctx, key, val)
+				}
+			}
+		}
+		if abort {
+			return nil, runErr
+		}
+	}
 
-		ctx = newCtx
+	b.worktreeDir, _ = ctx.Value(workingDirectoryContextKey).(string)
+
+	if runErr != nil {
+		return nil, runErr
 	}
 
 	rebuilds, ok := ctx.Value("rebuilds").([]string)
@@ -161,44 +369,160 @@ type Action interface {
 	Do(ctx context.Context) (context.Context, error)
 }
 
+// Cleanuper is implemented by actions that acquire a resource in Precheck/Do
+// that must be released once the builder is done running, regardless of
+// whether the run ultimately succeeded (e.g. a container started for
+// isolated builds, or a worktree checked out for the duration of a run).
+type Cleanuper interface {
+	Cleanup(ctx context.Context) error
+}
+
+// runCleanups runs every registered cleanup, most-recently-registered first,
+// so resources are torn down in the reverse of the order they were acquired.
+// Every cleanup is attempted even if an earlier one fails; failures are
+// logged rather than propagated since this runs from a defer after Run has
+// already returned its result.
+func runCleanups(ctx context.Context, cleanups []Cleanuper) {
+	for i := len(cleanups) - 1; i >= 0; i-- {
+		if err := cleanups[i].Cleanup(ctx); err != nil {
+			log.Println(warn("cleanup failed: "), err)
+		}
+	}
+}
+
+// workingDirectoryContextKey is published by actions that relocate the rest
+// of the run to a different directory (e.g. ChangesetIdentification's
+// UseWorktree). Actions that run after such an action should prefer this
+// over their own WorkingDirectory field.
+const workingDirectoryContextKey = "working-directory"
+
+// workingDirectoryFromContext returns the working directory a downstream
+// action should use: whatever an earlier action published into ctx, or
+// fallback if nothing was published.
+func workingDirectoryFromContext(ctx context.Context, fallback string) string {
+	if wd, ok := ctx.Value(workingDirectoryContextKey).(string); ok && len(wd) > 0 {
+		return wd
+	}
+	return fallback
+}
+
 type ChangesetIdentification struct {
+	// Source determines how the changeset is identified. Defaults to a
+	// *GitDiffTreeSource using GitRangeStart/GitRangeEnd when nil, for
+	// backwards compatibility with existing callers.
+	Source ChangesetSource
+
+	// GitRangeStart/GitRangeEnd are only consulted when Source is nil.
+	// GitRangeEnd is also used as the ref to check out when UseWorktree is
+	// set, regardless of Source.
 	GitRangeStart string
 	GitRangeEnd   string
 
 	WorkingDirectory string
+
+	// UseWorktree, when set, checks out GitRangeEnd into a temporary
+	// worktree and relocates the rest of the run there, so the build runs
+	// against a clean checkout rather than the (possibly dirty) working
+	// copy. The checkout itself only needs GitRangeEnd to be resolvable
+	// locally; what the changeset needs depends on Source.
+	UseWorktree bool
+
+	worktreeDir string
+
+	// sourceErr is set by NewBuilderFromCLI when the caller explicitly
+	// requested a changeset source (--changeset-source=github/gitlab) and
+	// it failed to resolve. It's surfaced as a hard Precheck failure rather
+	// than silently falling back to GitDiffTreeSource, which would
+	// reintroduce the shallow-clone failure mode an explicit source exists
+	// to avoid.
+	sourceErr error
 }
 
 var ErrInvalidGitRange = errors.New("invalid git range")
 
 func (c *ChangesetIdentification) Precheck(_ context.Context) error {
-	if len(c.GitRangeStart) == 0 || len(c.GitRangeEnd) == 0 {
+	if c.sourceErr != nil {
+		return c.sourceErr
+	}
+	if c.Source == nil && (len(c.GitRangeStart) == 0 || len(c.GitRangeEnd) == 0) {
+		return ErrInvalidGitRange
+	}
+	// UseWorktree always needs a ref to check out, regardless of Source: a
+	// configured Source only tells us how to list *changes*, not what to
+	// check out into the worktree. Catch a missing GitRangeEnd here instead
+	// of letting `git worktree add --detach <tmp> ""` fail with an opaque
+	// git error.
+	if c.UseWorktree && len(c.GitRangeEnd) == 0 {
 		return ErrInvalidGitRange
 	}
 	return nil
 }
 
-func (c *ChangesetIdentification) Do(ctx context.Context) (context.Context, error) {
-	log.Printf(`running: "git diff-tree --no-commit-id --name-only -r %s..%s"\n`, c.GitRangeEnd, c.GitRangeStart)
-	cmd := exec.Command(
-		"git",
-		"diff-tree",
-		"--no-commit-id",
-		"--name-only",
-		"-r",
-		fmt.Sprintf("%s..%s", c.GitRangeEnd, c.GitRangeStart),
-	)
-	if len(c.WorkingDirectory) > 0 {
-		cmd.Dir = c.WorkingDirectory
+func (c *ChangesetIdentification) source() ChangesetSource {
+	if c.Source != nil {
+		return c.Source
 	}
+	return &GitDiffTreeSource{
+		GitRangeStart:    c.GitRangeStart,
+		GitRangeEnd:      c.GitRangeEnd,
+		WorkingDirectory: c.WorkingDirectory,
+	}
+}
 
-	out, err := cmd.Output()
+func (c *ChangesetIdentification) Do(ctx context.Context) (context.Context, error) {
+	changes, err := c.source().Changes(ctx)
 	if err != nil {
 		return nil, err
 	}
-	changes := strings.Split(string(out), "\n")
 
 	log.Println("identified changes: ", changes)
-	return context.WithValue(ctx, "changes", changes), nil
+	ctx = context.WithValue(ctx, "changes", changes)
+
+	if !c.UseWorktree {
+		return ctx, nil
+	}
+
+	tmpDir, err := os.MkdirTemp("", "artifact-worktree-")
+	if err != nil {
+		return nil, err
+	}
+
+	worktreeAdd := &Command{
+		Name: "git",
+		Args: []string{"worktree", "add", "--detach", tmpDir, c.GitRangeEnd},
+		Dir:  c.WorkingDirectory,
+	}
+	log.Printf("running: %v\n", append([]string{worktreeAdd.Name}, worktreeAdd.Args...))
+	if err := worktreeAdd.ToExecCmd(ctx).Run(); err != nil {
+		return nil, err
+	}
+	c.worktreeDir = tmpDir
+
+	log.Println("rest of the run will operate out of worktree: ", tmpDir)
+	return context.WithValue(ctx, workingDirectoryContextKey, tmpDir), nil
+}
+
+// Cleanup removes the worktree created for UseWorktree, if one was created.
+func (c *ChangesetIdentification) Cleanup(ctx context.Context) error {
+	if len(c.worktreeDir) == 0 {
+		return nil
+	}
+
+	remove := &Command{
+		Name: "git",
+		Args: []string{"worktree", "remove", "--force", c.worktreeDir},
+		Dir:  c.WorkingDirectory,
+	}
+	if err := remove.ToExecCmd(ctx).Run(); err != nil {
+		return err
+	}
+
+	prune := &Command{
+		Name: "git",
+		Args: []string{"worktree", "prune"},
+		Dir:  c.WorkingDirectory,
+	}
+	return prune.ToExecCmd(ctx).Run()
 }
 
 type EntrypointIdentification struct {
@@ -218,7 +542,7 @@ func (c *EntrypointIdentification) Precheck(ctx context.Context) error {
 		return ErrNoChangesFound
 	}
 
-	pathOfInterest := filepath.Join(c.WorkingDirectory, c.Prefix)
+	pathOfInterest := filepath.Join(workingDirectoryFromContext(ctx, c.WorkingDirectory), c.Prefix)
 
 	// Ensure that our path exists.
 	dir, err := os.Open(pathOfInterest)
@@ -235,7 +559,7 @@ func (c *EntrypointIdentification) Precheck(ctx context.Context) error {
 func (c *EntrypointIdentification) Do(ctx context.Context) (context.Context, error) {
 	log.Printf("opening prefixed path: %q, will do nested check: %v\n", c.Prefix, !c.SkipNested)
 
-	pathOfInterest := filepath.Join(c.WorkingDirectory, c.Prefix)
+	pathOfInterest := filepath.Join(workingDirectoryFromContext(ctx, c.WorkingDirectory), c.Prefix)
 
 	if c.SkipNested {
 		// Simply return the path, we already know that it exists.
@@ -272,6 +596,10 @@ func (c *EntrypointIdentification) Do(ctx context.Context) (context.Context, err
 type EntrypointDependencyIdentification struct {
 	RepoBasename     string
 	WorkingDirectory string
+
+	// BuildFlags are passed through to the underlying `go/packages` driver,
+	// e.g. `-tags=integration` or `-mod=vendor`.
+	BuildFlags []string
 }
 
 func (e *EntrypointDependencyIdentification) Precheck(_ context.Context) error {
@@ -281,6 +609,10 @@ func (e *EntrypointDependencyIdentification) Precheck(_ context.Context) error {
 	return nil
 }
 
+// packagesLoadMode is what we need from the driver to walk the import graph
+// and tell in-repo packages apart from third-party/vendored ones.
+const packagesLoadMode = packages.NeedImports | packages.NeedDeps | packages.NeedModule | packages.NeedName
+
 func (e *EntrypointDependencyIdentification) Do(ctx context.Context) (context.Context, error) {
 	log.Println("beginning entrypoint dependency identification, repo basename is: ", e.RepoBasename)
 
@@ -289,36 +621,44 @@ func (e *EntrypointDependencyIdentification) Do(ctx context.Context) (context.Co
 		return nil, errors.New("no valid entrypoints were provided from previous step")
 	}
 
-	var entryMap = make(map[string][]string)
+	patterns := make([]string, len(entrypoints))
+	for i, entrypoint := range entrypoints {
+		patterns[i] = fmt.Sprintf("./%s", entrypoint)
+	}
+
+	pkgs, err := packages.Load(&packages.Config{
+		Mode:       packagesLoadMode,
+		Dir:        workingDirectoryFromContext(ctx, e.WorkingDirectory),
+		BuildFlags: e.BuildFlags,
+	}, patterns...)
+	if err != nil {
+		return nil, err
+	}
 
-	for _, entrypoint := range entrypoints {
-		cmd := exec.Command(
-			"go",
-			"list",
-			"-f",
-			`'{{ join .Deps "\n" }}'`,
-			fmt.Sprintf("./%s", entrypoint),
+	if len(pkgs) != len(entrypoints) {
+		return nil, fmt.Errorf(
+			"expected %d packages to be loaded for entrypoints, got %d",
+			len(entrypoints), len(pkgs),
 		)
-		cmd.Dir = e.WorkingDirectory
+	}
 
-		out, err := cmd.Output()
-		if err != nil {
-			return nil, err
-		}
+	// packages.Load reports per-package load/type errors via Package.Errors
+	// rather than through its own return value. Left unchecked, a package
+	// that fails to resolve yields an incomplete (or empty) Imports graph,
+	// which silently looks like "this entrypoint has no matching changed
+	// deps" downstream in ModifiedDependencies - exactly the false negative
+	// we can't afford in a build-gating tool.
+	if n := packages.PrintErrors(pkgs); n > 0 {
+		return nil, fmt.Errorf("%d package(s) failed to load cleanly, see errors above", n)
+	}
 
-		deps := strings.Split(string(out), "\n")
-		var depsOfInterest []string
-		for _, dep := range deps {
-			if strings.HasPrefix(dep, e.RepoBasename) {
-				log.Printf("for entrypoint %q, found dep %q\n", entrypoint, dep)
-				depsOfInterest = append(
-					depsOfInterest,
-					strings.TrimPrefix(dep, e.RepoBasename+"/"),
-				)
-			}
-		}
+	var entryMap = make(map[string][]string)
+	for i, pkg := range pkgs {
+		entrypoint := entrypoints[i]
 
+		depsOfInterest := inRepoDepsOfInterest(pkg, e.RepoBasename)
 		if len(depsOfInterest) > 0 {
+			log.Printf("for entrypoint %q, found deps %v\n", entrypoint, depsOfInterest)
 			entryMap[entrypoint] = depsOfInterest
 		}
 	}
@@ -326,6 +666,43 @@ func (e *EntrypointDependencyIdentification) Do(ctx context.Context) (context.Co
 	return context.WithValue(ctx, "dependencies", entryMap), nil
 }
 
+// inRepoDepsOfInterest walks pkg's import graph transitively and returns the
+// repo-relative paths (relative to repoBasename) of every transitively
+// imported package whose module path matches repoBasename, except the module
+// root package (PkgPath == repoBasename) itself. This replaces the
+// old substring match against `RepoBasename`, which would happily (and
+// incorrectly) match vendored or nested-module packages that merely shared a
+// prefix with the repo's import path.
+func inRepoDepsOfInterest(pkg *packages.Package, repoBasename string) []string {
+	visited := make(map[string]struct{})
+	var depsOfInterest []string
+
+	var walk func(p *packages.Package)
+	walk = func(p *packages.Package) {
+		if _, ok := visited[p.PkgPath]; ok {
+			return
+		}
+		visited[p.PkgPath] = struct{}{}
+
+		if p.Module != nil && p.Module.Path == repoBasename && p.PkgPath != repoBasename {
+			depsOfInterest = append(
+				depsOfInterest,
+				strings.TrimPrefix(p.PkgPath, repoBasename+"/"),
+			)
+		}
+
+		for _, imp := range p.Imports {
+			walk(imp)
+		}
+	}
+
+	for _, imp := range pkg.Imports {
+		walk(imp)
+	}
+
+	return depsOfInterest
+}
+
 type ModifiedDependencies struct{}
 
 func (m ModifiedDependencies) Precheck(_ context.Context) error {
@@ -421,10 +798,37 @@ func (e *OutputDependencies) Do(ctx context.Context) (context.Context, error) {
 	), nil
 }
 
+// TargetBuildOutput holds the separately captured stdout/stderr of a single
+// target's build, so concurrent builds don't interleave their output into a
+// single buffer.
+type TargetBuildOutput struct {
+	Stdout []byte
+	Stderr []byte
+
+	ExitCode int
+	Duration time.Duration
+}
+
 type RebuildTargets struct {
 	IsDryRun         bool
 	BuildCommand     string
 	WorkingDirectory string
+
+	// Jobs caps how many targets are rebuilt concurrently. Defaults to
+	// runtime.NumCPU() when <= 0.
+	Jobs int
+
+	// FailFast stops handing out new work to the worker pool as soon as the
+	// first target fails to build. Builds already in flight are allowed to
+	// finish. When false (the default), every target is attempted and all
+	// failures are reported together.
+	FailFast bool
+
+	// ForceAll is the inverse knob: when set, a failing target's error is
+	// recorded but never prevents siblings from being attempted, regardless
+	// of FailFast. This is the flag noted as a TODO in the original
+	// implementation.
+	ForceAll bool
 }
 
 func (r *RebuildTargets) Precheck(_ context.Context) error {
@@ -440,44 +844,129 @@ func makeLocalPath(str string) string {
 	sep := string(filepath.Separator)
 	return fmt.Sprintf(".%s%s%s", sep, str, sep)
 }
+
+// buildCommandFor tokenizes r.BuildCommand via ParseCommand and substitutes
+// {{entrypoint}} on a per-token basis (rather than in the raw command
+// string), so the substitution can't accidentally split or merge tokens.
+func (r *RebuildTargets) buildCommandFor(ctx context.Context, target string) (*Command, error) {
+	command, err := ParseCommand(r.BuildCommand)
+	if err != nil {
+		return nil, err
+	}
+
+	localPath := makeLocalPath(target)
+	command.Name = strings.ReplaceAll(command.Name, "{{entrypoint}}", localPath)
+	for i, arg := range command.Args {
+		command.Args[i] = strings.ReplaceAll(arg, "{{entrypoint}}", localPath)
+	}
+	command.Dir = workingDirectoryFromContext(ctx, r.WorkingDirectory)
+
+	return command, nil
+}
+
+func (r *RebuildTargets) jobs() int {
+	if r.Jobs > 0 {
+		return r.Jobs
+	}
+	return runtime.NumCPU()
+}
+
 func (r *RebuildTargets) Do(ctx context.Context) (context.Context, error) {
 	rebuilds, ok := ctx.Value("rebuilds").([]string)
 	if !ok {
 		return nil, errors.New("no valid targets to rebuild determined")
 	}
 
-	var targetOutputs = make(map[string][]byte)
+	runner := runnerFromContext(ctx)
+	if runner == nil {
+		runner = localRunner{}
+	}
+
+	var (
+		mu            sync.Mutex
+		targetOutputs = make(map[string]TargetBuildOutput)
+		buildErrs     []error
+		failFast      bool
+	)
+
+	sem := make(chan struct{}, r.jobs())
+	var wg sync.WaitGroup
 
 	for _, target := range rebuilds {
-		cmdToRun := strings.ReplaceAll(
-			r.BuildCommand,
-			"{{entrypoint}}",
-			makeLocalPath(target),
-		)
-		log.Printf("rebuilding target %q with command %q\n", target, cmdToRun)
+		mu.Lock()
+		stop := failFast
+		mu.Unlock()
+		if stop {
+			break
+		}
+
+		target := target
+		command, err := r.buildCommandFor(ctx, target)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", target, err)
+		}
+		log.Printf("[%s] rebuilding with command %v\n", target, append([]string{command.Name}, command.Args...))
 
 		if r.IsDryRun {
 			continue
 		}
 
-		// NOTE(ttacon): this needs to be cleaned up as it's exceedingly fragile
-		// Imagine adding an extra space on accident (e.g. "go   build").
-		pieces := strings.Split(cmdToRun, " ")
-
-		// Yes, this makes an assumption.
-		cmd := exec.Command(pieces[0], pieces[1:]...)
-		if len(r.WorkingDirectory) > 0 {
-			cmd.Dir = r.WorkingDirectory
+		sem <- struct{}{}
+
+		// A goroutine can be parked on the line above waiting for a slot
+		// for a while; by the time it gets one, FailFast may have tripped
+		// from a sibling's failure. Re-check before committing to spawn,
+		// so "stops handing out new work as soon as the first target
+		// fails" actually holds once the pool is saturated.
+		mu.Lock()
+		stop = failFast
+		mu.Unlock()
+		if stop {
+			<-sem
+			break
 		}
 
-		// TODO(ttacon): add --force-all flag to not stop at first build
-		// error.
-		out, err := cmd.Output()
-		if err != nil {
-			return nil, err
-		}
-		targetOutputs[target] = out
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			start := time.Now()
+			stdout, stderr, exitCode, err := runner.run(ctx, command)
+			duration := time.Since(start)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			targetOutputs[target] = TargetBuildOutput{
+				Stdout:   stdout,
+				Stderr:   stderr,
+				ExitCode: exitCode,
+				Duration: duration,
+			}
+			if err != nil {
+				log.Printf("[%s] build failed: %v\n", target, err)
+				buildErrs = append(buildErrs, fmt.Errorf("%s: %w", target, err))
+				if r.FailFast && !r.ForceAll {
+					failFast = true
+				}
+			}
+		}()
 	}
 
-	return context.WithValue(ctx, "build-logs", targetOutputs), nil
+	wg.Wait()
+
+	ctx = context.WithValue(ctx, "build-logs", targetOutputs)
+
+	// build-logs stays attached to ctx even on failure: builder.Run treats
+	// a non-nil context returned alongside an error as a partial success,
+	// so a downstream PersistArtifacts (if configured) still gets to write
+	// manifest.json/junit.xml/logs for the exact build-failure case they
+	// exist to report.
+	//
+	// ForceAll/FailFast only control whether new work keeps getting
+	// scheduled after a failure - they must never affect whether a failure
+	// is reported. A failed build under --force-all is still a failed
+	// build.
+	return ctx, errors.Join(buildErrs...)
 }
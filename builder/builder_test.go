@@ -0,0 +1,111 @@
+package builder
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// fakeModule builds a *packages.Module for the given module path, the only
+// field inRepoDepsOfInterest inspects.
+func fakeModule(path string) *packages.Module {
+	return &packages.Module{Path: path}
+}
+
+func TestInRepoDepsOfInterest(t *testing.T) {
+	const repoBasename = "github.com/ttacon/artifact"
+
+	// github.com/ttacon/artifact/builder/internal/foo (in-repo, leaf)
+	leaf := &packages.Package{
+		PkgPath: repoBasename + "/builder/internal/foo",
+		Module:  fakeModule(repoBasename),
+	}
+	// a vendored/third-party dep that merely shares a prefix with the repo's
+	// import path - must NOT be treated as in-repo.
+	lookalike := &packages.Package{
+		PkgPath: repoBasename + "extra/vendored",
+		Module:  fakeModule(repoBasename + "extra"),
+	}
+	// third-party dependency, no relation to the repo module at all.
+	thirdParty := &packages.Package{
+		PkgPath: "github.com/urfave/cli/v2",
+		Module:  fakeModule("github.com/urfave/cli/v2"),
+	}
+	// github.com/ttacon/artifact/builder (in-repo, imports leaf + thirdParty)
+	mid := &packages.Package{
+		PkgPath: repoBasename + "/builder",
+		Module:  fakeModule(repoBasename),
+		Imports: map[string]*packages.Package{
+			leaf.PkgPath:       leaf,
+			thirdParty.PkgPath: thirdParty,
+		},
+	}
+	// the entrypoint package itself - in-repo, but should never appear in
+	// its own dependency list.
+	entrypoint := &packages.Package{
+		PkgPath: repoBasename + "/cmd/foo",
+		Module:  fakeModule(repoBasename),
+		Imports: map[string]*packages.Package{
+			mid.PkgPath:       mid,
+			lookalike.PkgPath: lookalike,
+		},
+	}
+
+	got := inRepoDepsOfInterest(entrypoint, repoBasename)
+	sort.Strings(got)
+
+	want := []string{"builder", "builder/internal/foo"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("inRepoDepsOfInterest() = %v, want %v", got, want)
+	}
+}
+
+func TestInRepoDepsOfInterestHandlesImportCycles(t *testing.T) {
+	const repoBasename = "github.com/ttacon/artifact"
+
+	a := &packages.Package{
+		PkgPath: repoBasename + "/a",
+		Module:  fakeModule(repoBasename),
+	}
+	b := &packages.Package{
+		PkgPath: repoBasename + "/b",
+		Module:  fakeModule(repoBasename),
+	}
+	a.Imports = map[string]*packages.Package{b.PkgPath: b}
+	b.Imports = map[string]*packages.Package{a.PkgPath: a}
+
+	entrypoint := &packages.Package{
+		PkgPath: repoBasename + "/cmd/foo",
+		Module:  fakeModule(repoBasename),
+		Imports: map[string]*packages.Package{a.PkgPath: a},
+	}
+
+	got := inRepoDepsOfInterest(entrypoint, repoBasename)
+	sort.Strings(got)
+
+	want := []string{"a", "b"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("inRepoDepsOfInterest() = %v, want %v", got, want)
+	}
+}
+
+// TestChangesetIdentificationPrecheckFailsOnExplicitSourceError ensures an
+// explicitly requested --changeset-source that failed to resolve is reported
+// as a hard Precheck failure, rather than silently falling back to
+// GitDiffTreeSource once Do runs.
+func TestChangesetIdentificationPrecheckFailsOnExplicitSourceError(t *testing.T) {
+	wantErr := errors.New("failed to resolve explicit changeset source \"github\": missing GITHUB_TOKEN")
+	c := &ChangesetIdentification{
+		GitRangeStart: "HEAD~1",
+		GitRangeEnd:   "HEAD",
+		sourceErr:     wantErr,
+	}
+
+	if err := c.Precheck(context.Background()); !errors.Is(err, wantErr) {
+		t.Fatalf("Precheck() = %v, want %v", err, wantErr)
+	}
+}
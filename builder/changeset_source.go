@@ -0,0 +1,304 @@
+package builder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// ChangesetSource produces the set of changed files for a run. Implementations
+// exist for deriving this locally from git history as well as from a hosted
+// PR/MR's file list, so `artifact` can run on shallow CI clones that don't
+// have both ends of the range available locally.
+type ChangesetSource interface {
+	Changes(ctx context.Context) ([]string, error)
+}
+
+// GitDiffTreeSource is the original changeset source: it shells out to
+// `git diff-tree` between two locally-resolvable refs.
+type GitDiffTreeSource struct {
+	GitRangeStart string
+	GitRangeEnd   string
+
+	WorkingDirectory string
+}
+
+func (g *GitDiffTreeSource) Changes(ctx context.Context) ([]string, error) {
+	if len(g.GitRangeStart) == 0 || len(g.GitRangeEnd) == 0 {
+		return nil, ErrInvalidGitRange
+	}
+
+	command := &Command{
+		Name: "git",
+		Args: []string{
+			"diff-tree",
+			"--no-commit-id",
+			"--name-only",
+			"-r",
+			fmt.Sprintf("%s..%s", g.GitRangeEnd, g.GitRangeStart),
+		},
+		Dir: g.WorkingDirectory,
+	}
+
+	out, err := command.ToExecCmd(ctx).Output()
+	if err != nil {
+		return nil, err
+	}
+
+	return strings.Split(string(out), "\n"), nil
+}
+
+// githubPullRequestFile is the subset of GitHub's "pull request files" API
+// response we care about.
+// See: https://docs.github.com/en/rest/pulls/pulls#list-pull-requests-files
+type githubPullRequestFile struct {
+	Filename string `json:"filename"`
+}
+
+// GitHubPRSource fetches a PR's changed files via the GitHub REST API, so
+// neither ref needs to be present in a (potentially shallow) local clone.
+type GitHubPRSource struct {
+	Owner  string
+	Repo   string
+	Number int
+	Token  string
+
+	// APIBaseURL defaults to https://api.github.com when empty; overridable
+	// for GitHub Enterprise or tests.
+	APIBaseURL string
+
+	HTTPClient *http.Client
+}
+
+const githubPerPage = 100
+
+func (g *GitHubPRSource) Changes(ctx context.Context) ([]string, error) {
+	baseURL := g.APIBaseURL
+	if len(baseURL) == 0 {
+		baseURL = "https://api.github.com"
+	}
+	client := g.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	var allChanges []string
+	for page := 1; ; page++ {
+		url := fmt.Sprintf(
+			"%s/repos/%s/%s/pulls/%d/files?per_page=%d&page=%d",
+			baseURL, g.Owner, g.Repo, g.Number, githubPerPage, page,
+		)
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/vnd.github+json")
+		if len(g.Token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+g.Token)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("github: unexpected status %d: %s", resp.StatusCode, body)
+		}
+
+		var files []githubPullRequestFile
+		if err := json.Unmarshal(body, &files); err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			allChanges = append(allChanges, f.Filename)
+		}
+
+		if len(files) < githubPerPage {
+			break
+		}
+	}
+
+	return allChanges, nil
+}
+
+// gitlabMRChanges is the subset of GitLab's merge request "changes" API
+// response we care about.
+// See: https://docs.gitlab.com/ee/api/merge_requests.html#get-single-mr-changes
+type gitlabMRChanges struct {
+	Changes []struct {
+		NewPath string `json:"new_path"`
+		OldPath string `json:"old_path"`
+	} `json:"changes"`
+}
+
+// GitLabMRSource fetches a merge request's changed files via the GitLab API.
+type GitLabMRSource struct {
+	ProjectID string
+	MRIID     int
+	Token     string
+
+	// APIBaseURL defaults to https://gitlab.com/api/v4 when empty.
+	APIBaseURL string
+
+	HTTPClient *http.Client
+}
+
+func (g *GitLabMRSource) Changes(ctx context.Context) ([]string, error) {
+	baseURL := g.APIBaseURL
+	if len(baseURL) == 0 {
+		baseURL = "https://gitlab.com/api/v4"
+	}
+	client := g.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	url := fmt.Sprintf(
+		"%s/projects/%s/merge_requests/%d/changes",
+		baseURL, g.ProjectID, g.MRIID,
+	)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(g.Token) > 0 {
+		req.Header.Set("PRIVATE-TOKEN", g.Token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("gitlab: unexpected status %d: %s", resp.StatusCode, body)
+	}
+
+	var changes gitlabMRChanges
+	if err := json.Unmarshal(body, &changes); err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, len(changes.Changes))
+	for i, change := range changes.Changes {
+		paths[i] = change.NewPath
+	}
+	return paths, nil
+}
+
+// githubPullRequestEvent is the subset of a GitHub Actions `pull_request`
+// event payload we need to auto-detect the PR number when
+// GITHUB_EVENT_PATH is set.
+type githubPullRequestEvent struct {
+	PullRequest struct {
+		Number int `json:"number"`
+	} `json:"pull_request"`
+}
+
+// changesetSourceFromCLI resolves which ChangesetSource to use, preferring
+// an explicit --changeset-source flag and otherwise auto-detecting from CI
+// envvars (e.g. GITHUB_EVENT_PATH, as set by GitHub Actions).
+func changesetSourceFromCLI(explicit, workingDir, gitRangeStart, gitRangeEnd string) (ChangesetSource, error) {
+	switch explicit {
+	case "github":
+		return githubSourceFromEnv()
+	case "gitlab":
+		return gitlabSourceFromEnv()
+	case "git-diff-tree", "":
+		// handled below; auto-detection only applies when no source was given
+	default:
+		return nil, fmt.Errorf("unknown changeset source: %q", explicit)
+	}
+
+	if explicit == "" {
+		if eventPath, ok := findValueFromEnv([]string{"GITHUB_EVENT_PATH"}); ok {
+			if src, err := githubSourceFromEventFile(eventPath); err == nil {
+				return src, nil
+			}
+		}
+	}
+
+	return &GitDiffTreeSource{
+		GitRangeStart:    gitRangeStart,
+		GitRangeEnd:      gitRangeEnd,
+		WorkingDirectory: workingDir,
+	}, nil
+}
+
+func githubSourceFromEnv() (ChangesetSource, error) {
+	if eventPath, ok := findValueFromEnv([]string{"GITHUB_EVENT_PATH"}); ok {
+		return githubSourceFromEventFile(eventPath)
+	}
+	return nil, fmt.Errorf("could not determine GitHub PR number: GITHUB_EVENT_PATH not set")
+}
+
+func githubSourceFromEventFile(eventPath string) (ChangesetSource, error) {
+	data, err := os.ReadFile(eventPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var event githubPullRequestEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		return nil, err
+	}
+	if event.PullRequest.Number == 0 {
+		return nil, fmt.Errorf("event at %q is not a pull_request event", eventPath)
+	}
+
+	repo, _ := findValueFromEnv([]string{"GITHUB_REPOSITORY"})
+	owner, name, ok := strings.Cut(repo, "/")
+	if !ok {
+		return nil, fmt.Errorf("could not parse GITHUB_REPOSITORY: %q", repo)
+	}
+
+	token, _ := findValueFromEnv([]string{"GITHUB_TOKEN"})
+
+	return &GitHubPRSource{
+		Owner:  owner,
+		Repo:   name,
+		Number: event.PullRequest.Number,
+		Token:  token,
+	}, nil
+}
+
+func gitlabSourceFromEnv() (ChangesetSource, error) {
+	projectID, ok := findValueFromEnv([]string{"CI_PROJECT_ID"})
+	if !ok {
+		return nil, fmt.Errorf("could not determine GitLab project id: CI_PROJECT_ID not set")
+	}
+	mrIID, ok := findValueFromEnv([]string{"CI_MERGE_REQUEST_IID"})
+	if !ok {
+		return nil, fmt.Errorf("could not determine GitLab merge request iid: CI_MERGE_REQUEST_IID not set")
+	}
+
+	var iid int
+	if _, err := fmt.Sscanf(mrIID, "%d", &iid); err != nil {
+		return nil, fmt.Errorf("could not parse CI_MERGE_REQUEST_IID %q: %w", mrIID, err)
+	}
+
+	token, _ := findValueFromEnv([]string{"GITLAB_TOKEN", "CI_JOB_TOKEN"})
+
+	return &GitLabMRSource{
+		ProjectID: projectID,
+		MRIID:     iid,
+		Token:     token,
+	}, nil
+}
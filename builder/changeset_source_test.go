@@ -0,0 +1,120 @@
+package builder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestGitHubPRSourceChangesPaginates(t *testing.T) {
+	const perPage = githubPerPage
+
+	pages := [][]githubPullRequestFile{
+		make([]githubPullRequestFile, perPage),
+		{{Filename: "cmd/foo/main.go"}, {Filename: "README.md"}},
+	}
+	for i := range pages[0] {
+		pages[0][i] = githubPullRequestFile{Filename: fmt.Sprintf("file_%d.go", i)}
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.URL.Query().Get("page"); got != "1" && got != "2" {
+			t.Fatalf("unexpected page requested: %q", got)
+		}
+		page := 1
+		fmt.Sscanf(r.URL.Query().Get("page"), "%d", &page)
+
+		w.Header().Set("Content-Type", "application/json")
+		writeJSON(t, w, pages[page-1])
+	}))
+	defer srv.Close()
+
+	src := &GitHubPRSource{
+		Owner:      "ttacon",
+		Repo:       "artifact",
+		Number:     42,
+		APIBaseURL: srv.URL,
+		HTTPClient: srv.Client(),
+	}
+
+	got, err := src.Changes(context.Background())
+	if err != nil {
+		t.Fatalf("Changes: unexpected error: %v", err)
+	}
+
+	var want []string
+	for _, f := range pages[0] {
+		want = append(want, f.Filename)
+	}
+	want = append(want, "cmd/foo/main.go", "README.md")
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Changes() = %v, want %v", got, want)
+	}
+}
+
+func TestGitHubPRSourceChangesNonOKStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not found", http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	src := &GitHubPRSource{
+		Owner:      "ttacon",
+		Repo:       "artifact",
+		Number:     42,
+		APIBaseURL: srv.URL,
+		HTTPClient: srv.Client(),
+	}
+
+	if _, err := src.Changes(context.Background()); err == nil {
+		t.Fatalf("Changes: expected an error for a non-200 response")
+	}
+}
+
+func TestGitLabMRSourceChanges(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got, want := r.Header.Get("PRIVATE-TOKEN"), "secret"; got != want {
+			t.Fatalf("PRIVATE-TOKEN header = %q, want %q", got, want)
+		}
+		writeJSON(t, w, gitlabMRChanges{
+			Changes: []struct {
+				NewPath string `json:"new_path"`
+				OldPath string `json:"old_path"`
+			}{
+				{NewPath: "cmd/foo/main.go", OldPath: "cmd/foo/main.go"},
+				{NewPath: "README.md", OldPath: ""},
+			},
+		})
+	}))
+	defer srv.Close()
+
+	src := &GitLabMRSource{
+		ProjectID:  "123",
+		MRIID:      7,
+		Token:      "secret",
+		APIBaseURL: srv.URL,
+		HTTPClient: srv.Client(),
+	}
+
+	got, err := src.Changes(context.Background())
+	if err != nil {
+		t.Fatalf("Changes: unexpected error: %v", err)
+	}
+
+	want := []string{"cmd/foo/main.go", "README.md"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Changes() = %v, want %v", got, want)
+	}
+}
+
+func writeJSON(t *testing.T, w http.ResponseWriter, v interface{}) {
+	t.Helper()
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		t.Fatalf("failed to write JSON response: %v", err)
+	}
+}
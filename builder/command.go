@@ -0,0 +1,112 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+
+	"github.com/google/shlex"
+)
+
+// Flag is a single CLI flag, e.g. `--no-commit-id` (Value empty) or
+// `-f <value>` (Value set).
+type Flag struct {
+	Name  string
+	Value string
+}
+
+// argv renders the flag as it should appear in an argv slice.
+func (f Flag) argv() []string {
+	if len(f.Value) == 0 {
+		return []string{f.Name}
+	}
+	return []string{f.Name, f.Value}
+}
+
+// Command is our one audited path for constructing subprocesses. Every place
+// in this package that used to build up argv by hand (or, worse, split a
+// whole command line on spaces) should go through this instead, so that
+// quoting, flags and env are all handled consistently.
+type Command struct {
+	Name  string
+	Flags []Flag
+	Args  []string
+	Env   []string
+	Dir   string
+}
+
+// ToExecCmd assembles the Command into an *exec.Cmd, bound to ctx.
+func (c *Command) ToExecCmd(ctx context.Context) *exec.Cmd {
+	var argv []string
+	for _, flag := range c.Flags {
+		argv = append(argv, flag.argv()...)
+	}
+	argv = append(argv, c.Args...)
+
+	cmd := exec.CommandContext(ctx, c.Name, argv...)
+	cmd.Dir = c.Dir
+	if len(c.Env) > 0 {
+		cmd.Env = append(os.Environ(), c.Env...)
+	}
+	return cmd
+}
+
+// ErrEmptyCommand is returned when a command line tokenizes down to nothing
+// runnable.
+var ErrEmptyCommand = errors.New("empty command")
+
+// ParseCommand tokenizes raw (a shell-like command line, e.g. from
+// --build-command) using shlex, so quoted arguments containing spaces are
+// respected, and returns the resulting Command. Unlike Flags built up by
+// hand elsewhere in this package, tokens parsed this way have no reliable
+// way to be split into "flags" vs. "args", so they're all placed in Args.
+func ParseCommand(raw string) (*Command, error) {
+	tokens, err := shlex.Split(raw)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, ErrEmptyCommand
+	}
+
+	return &Command{
+		Name: tokens[0],
+		Args: tokens[1:],
+	}, nil
+}
+
+// commandRunner abstracts over how a Command is actually executed, so
+// RebuildTargets can run locally or inside a long-lived build container
+// (see ContainerBuilder) without caring which. exitCode is the process's
+// exit code when it could be determined, or -1 otherwise (e.g. the process
+// never started).
+type commandRunner interface {
+	run(ctx context.Context, command *Command) (stdout, stderr []byte, exitCode int, err error)
+}
+
+// localRunner runs the Command as a regular local subprocess.
+type localRunner struct{}
+
+func (localRunner) run(ctx context.Context, command *Command) ([]byte, []byte, int, error) {
+	cmd := command.ToExecCmd(ctx)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+
+	exitCode := 0
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			exitCode = exitErr.ExitCode()
+		} else {
+			exitCode = -1
+		}
+	}
+
+	return stdout.Bytes(), stderr.Bytes(), exitCode, err
+}
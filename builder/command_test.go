@@ -0,0 +1,168 @@
+package builder
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		want    *Command
+		wantErr bool
+	}{
+		{
+			name: "simple",
+			raw:  "go build ./...",
+			want: &Command{Name: "go", Args: []string{"build", "./..."}},
+		},
+		{
+			name: "quoted argument with spaces",
+			raw:  `echo "hello world"`,
+			want: &Command{Name: "echo", Args: []string{"hello world"}},
+		},
+		{
+			name:    "empty",
+			raw:     "   ",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseCommand(tt.raw)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseCommand(%q): expected error, got none", tt.raw)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseCommand(%q): unexpected error: %v", tt.raw, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("ParseCommand(%q) = %+v, want %+v", tt.raw, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRebuildTargetsBuildCommandFor(t *testing.T) {
+	r := &RebuildTargets{
+		BuildCommand:     "go build -o {{entrypoint}}/bin {{entrypoint}}",
+		WorkingDirectory: "/repo",
+	}
+
+	got, err := r.buildCommandFor(context.Background(), "cmd/foo")
+	if err != nil {
+		t.Fatalf("buildCommandFor: unexpected error: %v", err)
+	}
+
+	wantLocalPath := "./cmd/foo/"
+	want := &Command{
+		Name: "go",
+		Args: []string{"build", "-o", wantLocalPath + "/bin", wantLocalPath},
+		Dir:  "/repo",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("buildCommandFor(cmd/foo) = %+v, want %+v", got, want)
+	}
+}
+
+func TestRebuildTargetsBuildCommandForUsesContextWorkingDirectory(t *testing.T) {
+	r := &RebuildTargets{
+		BuildCommand:     "go build {{entrypoint}}",
+		WorkingDirectory: "/repo",
+	}
+
+	ctx := context.WithValue(context.Background(), workingDirectoryContextKey, "/tmp/worktree")
+
+	got, err := r.buildCommandFor(ctx, "cmd/foo")
+	if err != nil {
+		t.Fatalf("buildCommandFor: unexpected error: %v", err)
+	}
+	if got.Dir != "/tmp/worktree" {
+		t.Fatalf("buildCommandFor: Dir = %q, want the worktree dir published in ctx", got.Dir)
+	}
+}
+
+// TestRebuildTargetsDoAlwaysReportsFailures runs RebuildTargets.Do against one "bad" target (which
+// always fails: `test {{entrypoint}} != ./bad/` is false when entrypoint is
+// bad) and two "good" targets, and asserts that a failure is always reported
+// regardless of FailFast/ForceAll - only whether every target gets attempted
+// should vary.
+func TestRebuildTargetsDoAlwaysReportsFailures(t *testing.T) {
+	tests := []struct {
+		name     string
+		failFast bool
+		forceAll bool
+		// wantAttempted is which targets should have an entry in build-logs;
+		// with FailFast and Jobs=1, "good2" (scheduled after "bad") must
+		// never be attempted.
+		wantAttempted []string
+	}{
+		{
+			name:          "default",
+			wantAttempted: []string{"good1", "bad", "good2"},
+		},
+		{
+			name:          "force-all",
+			forceAll:      true,
+			wantAttempted: []string{"good1", "bad", "good2"},
+		},
+		{
+			name:          "fail-fast",
+			failFast:      true,
+			wantAttempted: []string{"good1", "bad"},
+		},
+		{
+			name:          "fail-fast and force-all",
+			failFast:      true,
+			forceAll:      true,
+			wantAttempted: []string{"good1", "bad", "good2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &RebuildTargets{
+				BuildCommand: "test {{entrypoint}} != ./bad/",
+				Jobs:         1,
+				FailFast:     tt.failFast,
+				ForceAll:     tt.forceAll,
+			}
+
+			ctx := context.WithValue(context.Background(), "rebuilds", []string{"good1", "bad", "good2"})
+
+			newCtx, err := r.Do(ctx)
+			if err == nil {
+				t.Fatalf("Do(): expected the build failure to be reported regardless of ForceAll/FailFast")
+			}
+			if newCtx == nil {
+				t.Fatalf("Do(): expected a non-nil context even on failure, so PersistArtifacts can still run")
+			}
+
+			logs, ok := newCtx.Value("build-logs").(map[string]TargetBuildOutput)
+			if !ok {
+				t.Fatalf("Do(): expected build-logs to be present in the returned context")
+			}
+
+			var attempted []string
+			for target := range logs {
+				attempted = append(attempted, target)
+			}
+			sort.Strings(attempted)
+			sort.Strings(tt.wantAttempted)
+			if !reflect.DeepEqual(attempted, tt.wantAttempted) {
+				t.Fatalf("Do(): attempted targets = %v, want %v", attempted, tt.wantAttempted)
+			}
+
+			if logs["bad"].ExitCode == 0 {
+				t.Fatalf("Do(): bad target's exit code = 0, want non-zero")
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// dockerClientContextKey and dockerContainerContextKey are the context keys
+// ContainerBuilder publishes so that RebuildTargets can discover the
+// long-lived build container, if one was started.
+const (
+	dockerClientContextKey    = "docker-client"
+	dockerContainerContextKey = "container-id"
+)
+
+// ContainerBuilder starts a single long-lived container from Image once (in
+// Do, having been validated in Precheck) and leaves it running for the rest
+// of the build. This follows the same approach `act` uses for its job
+// containers: create one container and `docker exec` every step into it,
+// rather than paying container-startup cost per `cmd/` target. Registered as
+// an action only when `--builder-image` is set.
+type ContainerBuilder struct {
+	Image            string
+	WorkingDirectory string
+
+	// Keep leaves the container running after the build finishes, for
+	// debugging.
+	Keep bool
+
+	cli         *client.Client
+	containerID string
+}
+
+var ErrNoBuilderImage = errors.New("no builder image provided")
+
+func (c *ContainerBuilder) Precheck(_ context.Context) error {
+	if len(c.Image) == 0 {
+		return ErrNoBuilderImage
+	}
+
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return err
+	}
+	c.cli = cli
+
+	return nil
+}
+
+func (c *ContainerBuilder) Do(ctx context.Context) (context.Context, error) {
+	workingDirectory := workingDirectoryFromContext(ctx, c.WorkingDirectory)
+
+	log.Println("pulling builder image: ", c.Image)
+	pulled, err := c.cli.ImagePull(ctx, c.Image, types.ImagePullOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// The pull response must be drained for the pull to actually complete.
+	_, err = io.Copy(io.Discard, pulled)
+	pulled.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.cli.ContainerCreate(
+		ctx,
+		&container.Config{
+			Image:      c.Image,
+			Cmd:        []string{"sleep", "infinity"},
+			WorkingDir: "/workspace",
+			Env: []string{
+				"GOCACHE=/root/.cache/go-build",
+				"GOMODCACHE=/go/pkg/mod",
+			},
+		},
+		&container.HostConfig{
+			Mounts: []mount.Mount{
+				{
+					Type:   mount.TypeBind,
+					Source: workingDirectory,
+					Target: "/workspace",
+				},
+				{
+					Type:   mount.TypeVolume,
+					Source: "artifact-gocache",
+					Target: "/root/.cache/go-build",
+				},
+				{
+					Type:   mount.TypeVolume,
+					Source: "artifact-gomodcache",
+					Target: "/go/pkg/mod",
+				},
+			},
+		},
+		nil,
+		nil,
+		"",
+	)
+	if err != nil {
+		return nil, err
+	}
+	c.containerID = resp.ID
+
+	if err := c.cli.ContainerStart(ctx, c.containerID, types.ContainerStartOptions{}); err != nil {
+		return nil, err
+	}
+	log.Println("started builder container: ", c.containerID)
+
+	ctx = context.WithValue(ctx, dockerClientContextKey, c.cli)
+	ctx = context.WithValue(ctx, dockerContainerContextKey, c.containerID)
+	return ctx, nil
+}
+
+// Cleanup stops and removes the builder container, unless Keep is set.
+func (c *ContainerBuilder) Cleanup(ctx context.Context) error {
+	if c.cli == nil || len(c.containerID) == 0 {
+		return nil
+	}
+	if c.Keep {
+		log.Println("--builder-keep set, leaving builder container running: ", c.containerID)
+		return nil
+	}
+
+	log.Println("tearing down builder container: ", c.containerID)
+	timeout := 5 * time.Second
+	if err := c.cli.ContainerStop(ctx, c.containerID, &timeout); err != nil {
+		return err
+	}
+	return c.cli.ContainerRemove(ctx, c.containerID, types.ContainerRemoveOptions{Force: true})
+}
+
+// containerRunner runs a Command via the Docker SDK's `ContainerExec`
+// against an already-running container, instead of spawning a local
+// subprocess.
+type containerRunner struct {
+	cli         *client.Client
+	containerID string
+}
+
+func (r containerRunner) run(ctx context.Context, command *Command) ([]byte, []byte, int, error) {
+	argv := []string{command.Name}
+	for _, flag := range command.Flags {
+		argv = append(argv, flag.argv()...)
+	}
+	argv = append(argv, command.Args...)
+
+	exec, err := r.cli.ContainerExecCreate(ctx, r.containerID, types.ExecConfig{
+		Cmd:          argv,
+		Env:          command.Env,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return nil, nil, -1, err
+	}
+
+	attached, err := r.cli.ContainerExecAttach(ctx, exec.ID, types.ExecStartCheck{})
+	if err != nil {
+		return nil, nil, -1, err
+	}
+	defer attached.Close()
+
+	var stdout, stderr bytes.Buffer
+	if _, err := stdcopy.StdCopy(&stdout, &stderr, attached.Reader); err != nil {
+		return stdout.Bytes(), stderr.Bytes(), -1, err
+	}
+
+	inspected, err := r.cli.ContainerExecInspect(ctx, exec.ID)
+	if err != nil {
+		return stdout.Bytes(), stderr.Bytes(), -1, err
+	}
+	if inspected.ExitCode != 0 {
+		return stdout.Bytes(), stderr.Bytes(), inspected.ExitCode, fmt.Errorf("exec exited with code %d", inspected.ExitCode)
+	}
+
+	return stdout.Bytes(), stderr.Bytes(), inspected.ExitCode, nil
+}
+
+// runnerFromContext returns a containerRunner if a ContainerBuilder has
+// published a running container into ctx, or nil otherwise.
+func runnerFromContext(ctx context.Context) commandRunner {
+	cli, ok := ctx.Value(dockerClientContextKey).(*client.Client)
+	if !ok {
+		return nil
+	}
+	containerID, ok := ctx.Value(dockerContainerContextKey).(string)
+	if !ok {
+		return nil
+	}
+	return containerRunner{cli: cli, containerID: containerID}
+}
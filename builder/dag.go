@@ -0,0 +1,66 @@
+package builder
+
+import "fmt"
+
+// dagNode is one unit of work in the builder's action graph: an Action, the
+// names of other nodes it depends on, and the context keys it publishes once
+// it completes. Nodes with all dependencies satisfied by earlier levels run
+// concurrently with one another; see builder.Run.
+type dagNode struct {
+	name      string
+	action    Action
+	dependsOn []string
+	produces  []string
+}
+
+// topoLevels groups nodes into levels such that every node in a level has
+// all of its dependencies satisfied by strictly earlier levels. Nodes within
+// the same level have no dependency relationship between them and can
+// therefore run concurrently. This is a small, homegrown topological
+// scheduler (Kahn's algorithm, layered).
+func topoLevels(nodes []dagNode) ([][]dagNode, error) {
+	byName := make(map[string]dagNode, len(nodes))
+	for _, n := range nodes {
+		if _, dup := byName[n.name]; dup {
+			return nil, fmt.Errorf("duplicate action name: %q", n.name)
+		}
+		byName[n.name] = n
+	}
+	for _, n := range nodes {
+		for _, dep := range n.dependsOn {
+			if _, ok := byName[dep]; !ok {
+				return nil, fmt.Errorf("action %q depends on unknown action %q", n.name, dep)
+			}
+		}
+	}
+
+	remaining := make(map[string]dagNode, len(nodes))
+	for _, n := range nodes {
+		remaining[n.name] = n
+	}
+
+	var levels [][]dagNode
+	for len(remaining) > 0 {
+		var level []dagNode
+		for _, n := range remaining {
+			ready := true
+			for _, dep := range n.dependsOn {
+				if _, unmet := remaining[dep]; unmet {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				level = append(level, n)
+			}
+		}
+		if len(level) == 0 {
+			return nil, fmt.Errorf("cycle detected among remaining actions (%d left)", len(remaining))
+		}
+		for _, n := range level {
+			delete(remaining, n.name)
+		}
+		levels = append(levels, level)
+	}
+	return levels, nil
+}
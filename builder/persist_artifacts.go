@@ -0,0 +1,299 @@
+package builder
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// workspaceMtimesContextKey is where WorkspaceSnapshot publishes its
+// pre-build file mtimes, for PersistArtifacts to diff against afterwards.
+const workspaceMtimesContextKey = "pre-build-mtimes"
+
+// WorkspaceSnapshot records the mtime of every regular file under
+// WorkingDirectory before RebuildTargets runs, so that PersistArtifacts can
+// later tell which files a build actually produced or touched. It's only
+// registered when an artifacts directory was requested, since walking the
+// whole tree isn't free.
+type WorkspaceSnapshot struct {
+	WorkingDirectory string
+}
+
+func (w *WorkspaceSnapshot) Precheck(_ context.Context) error {
+	return nil
+}
+
+func (w *WorkspaceSnapshot) Do(ctx context.Context) (context.Context, error) {
+	mtimes, err := walkMtimes(workingDirectoryFromContext(ctx, w.WorkingDirectory))
+	if err != nil {
+		return nil, err
+	}
+	return context.WithValue(ctx, workspaceMtimesContextKey, mtimes), nil
+}
+
+func walkMtimes(root string) (map[string]time.Time, error) {
+	mtimes := make(map[string]time.Time)
+	if len(root) == 0 {
+		root = "."
+	}
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		mtimes[path] = info.ModTime()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return mtimes, nil
+}
+
+// ArtifactManifest is the top-level shape of manifest.json.
+type ArtifactManifest struct {
+	GitRangeStart  string                `json:"gitRangeStart"`
+	GitRangeEnd    string                `json:"gitRangeEnd"`
+	Entrypoints    []string              `json:"entrypoints"`
+	Dependencies   map[string][]string   `json:"dependencies"`
+	RebuildTargets []string              `json:"rebuildTargets"`
+	BuildCommand   string                `json:"buildCommand"`
+	Targets        []TargetManifestEntry `json:"targets"`
+	Artifacts      []BinaryManifestEntry `json:"artifacts"`
+}
+
+// TargetManifestEntry records the outcome of rebuilding a single target.
+type TargetManifestEntry struct {
+	Name       string `json:"name"`
+	ExitCode   int    `json:"exitCode"`
+	DurationMS int64  `json:"durationMs"`
+}
+
+// BinaryManifestEntry records a file that changed (or was newly created)
+// under WorkingDirectory over the course of the build, along with its
+// SHA256.
+type BinaryManifestEntry struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+}
+
+// PersistArtifacts writes per-target build logs, a machine-readable
+// manifest.json and a junit.xml to ArtifactsDir. It's registered as the last
+// action, and only when --artifacts-dir is non-empty.
+type PersistArtifacts struct {
+	ArtifactsDir     string
+	WorkingDirectory string
+	BuildCommand     string
+	GitRangeStart    string
+	GitRangeEnd      string
+}
+
+func (p *PersistArtifacts) Precheck(_ context.Context) error {
+	if len(p.ArtifactsDir) == 0 {
+		return errors.New("must provide an artifacts directory")
+	}
+	return nil
+}
+
+func (p *PersistArtifacts) Do(ctx context.Context) (context.Context, error) {
+	if err := os.MkdirAll(p.ArtifactsDir, 0o755); err != nil {
+		return nil, err
+	}
+
+	entrypoints, _ := ctx.Value("entrypoints").([]string)
+	dependencies, _ := ctx.Value("dependencies").(map[string][]string)
+	rebuilds, _ := ctx.Value("rebuilds").([]string)
+	buildLogs, _ := ctx.Value("build-logs").(map[string]TargetBuildOutput)
+	preBuildMtimes, _ := ctx.Value(workspaceMtimesContextKey).(map[string]time.Time)
+
+	// discoverArtifacts must run before anything below writes into
+	// ArtifactsDir: it diffs WorkingDirectory's mtimes against
+	// preBuildMtimes to find files the build produced, and ArtifactsDir is
+	// typically nested under WorkingDirectory in CI. Writing stdout.log/
+	// stderr.log first would make the tool's own just-written logs show up
+	// in the manifest's artifacts list instead of real build outputs.
+	artifacts, err := p.discoverArtifacts(ctx, preBuildMtimes)
+	if err != nil {
+		return nil, err
+	}
+
+	targets, err := p.writeTargetLogs(buildLogs)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := ArtifactManifest{
+		GitRangeStart:  p.GitRangeStart,
+		GitRangeEnd:    p.GitRangeEnd,
+		Entrypoints:    entrypoints,
+		Dependencies:   dependencies,
+		RebuildTargets: rebuilds,
+		BuildCommand:   p.BuildCommand,
+		Targets:        targets,
+		Artifacts:      artifacts,
+	}
+
+	if err := p.writeManifest(manifest); err != nil {
+		return nil, err
+	}
+	if err := p.writeJUnit(manifest); err != nil {
+		return nil, err
+	}
+
+	log.Println("persisted build artifacts to: ", p.ArtifactsDir)
+	return ctx, nil
+}
+
+func sanitizeTargetName(target string) string {
+	return strings.ReplaceAll(target, string(filepath.Separator), "_")
+}
+
+func (p *PersistArtifacts) writeTargetLogs(buildLogs map[string]TargetBuildOutput) ([]TargetManifestEntry, error) {
+	var targets []TargetManifestEntry
+
+	for target, output := range buildLogs {
+		targetDir := filepath.Join(p.ArtifactsDir, sanitizeTargetName(target))
+		if err := os.MkdirAll(targetDir, 0o755); err != nil {
+			return nil, err
+		}
+
+		if err := os.WriteFile(filepath.Join(targetDir, "stdout.log"), output.Stdout, 0o644); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(filepath.Join(targetDir, "stderr.log"), output.Stderr, 0o644); err != nil {
+			return nil, err
+		}
+
+		targets = append(targets, TargetManifestEntry{
+			Name:       target,
+			ExitCode:   output.ExitCode,
+			DurationMS: output.Duration.Milliseconds(),
+		})
+	}
+
+	return targets, nil
+}
+
+func (p *PersistArtifacts) discoverArtifacts(ctx context.Context, preBuildMtimes map[string]time.Time) ([]BinaryManifestEntry, error) {
+	workingDirectory := workingDirectoryFromContext(ctx, p.WorkingDirectory)
+
+	postBuildMtimes, err := walkMtimes(workingDirectory)
+	if err != nil {
+		return nil, err
+	}
+
+	var artifacts []BinaryManifestEntry
+	for path, mtime := range postBuildMtimes {
+		before, existedBefore := preBuildMtimes[path]
+		if existedBefore && !mtime.After(before) {
+			continue
+		}
+
+		sum, err := sha256File(path)
+		if err != nil {
+			return nil, err
+		}
+
+		artifacts = append(artifacts, BinaryManifestEntry{
+			Path:   path,
+			SHA256: sum,
+		})
+	}
+
+	return artifacts, nil
+}
+
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (p *PersistArtifacts) writeManifest(manifest ArtifactManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(p.ArtifactsDir, "manifest.json"), data, 0o644)
+}
+
+// junitTestSuite/junitTestCase are a minimal subset of the JUnit XML schema,
+// enough for CI systems to display per-target pass/fail.
+type junitTestSuite struct {
+	XMLName   xml.Name        `xml:"testsuite"`
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	TimeS     float64       `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Content string `xml:",chardata"`
+}
+
+func (p *PersistArtifacts) writeJUnit(manifest ArtifactManifest) error {
+	suite := junitTestSuite{
+		Name:  "artifact-rebuild",
+		Tests: len(manifest.Targets),
+	}
+
+	for _, target := range manifest.Targets {
+		testCase := junitTestCase{
+			Name:      target.Name,
+			ClassName: "artifact.build",
+			TimeS:     float64(target.DurationMS) / 1000.0,
+		}
+		if target.ExitCode != 0 {
+			suite.Failures++
+			testCase.Failure = &junitFailure{
+				Message: fmt.Sprintf("build exited with code %d", target.ExitCode),
+			}
+		}
+		suite.TestCases = append(suite.TestCases, testCase)
+	}
+
+	data, err := xml.MarshalIndent(suite, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append([]byte(xml.Header), data...)
+
+	return os.WriteFile(filepath.Join(p.ArtifactsDir, "junit.xml"), data, 0o644)
+}
@@ -0,0 +1,92 @@
+package builder
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestWalkMtimesSkipsGitDir(t *testing.T) {
+	root := t.TempDir()
+
+	write(t, filepath.Join(root, "main.go"), "package main")
+	write(t, filepath.Join(root, ".git", "HEAD"), "ref: refs/heads/master")
+
+	mtimes, err := walkMtimes(root)
+	if err != nil {
+		t.Fatalf("walkMtimes: unexpected error: %v", err)
+	}
+
+	if _, ok := mtimes[filepath.Join(root, "main.go")]; !ok {
+		t.Fatalf("walkMtimes: expected main.go to be tracked")
+	}
+	if _, ok := mtimes[filepath.Join(root, ".git", "HEAD")]; ok {
+		t.Fatalf("walkMtimes: .git contents should have been skipped")
+	}
+}
+
+func TestDiscoverArtifactsOnlyReportsNewOrChangedFiles(t *testing.T) {
+	root := t.TempDir()
+
+	unchanged := filepath.Join(root, "unchanged.txt")
+	changed := filepath.Join(root, "cmd", "foo")
+	write(t, unchanged, "stays the same")
+	write(t, changed, "old binary")
+
+	preBuildMtimes, err := walkMtimes(root)
+	if err != nil {
+		t.Fatalf("walkMtimes (pre): unexpected error: %v", err)
+	}
+
+	// Simulate a build: rewrite `changed` (bumping its mtime) and add a
+	// brand new output, leaving `unchanged` untouched.
+	bumpMtime(t, changed, preBuildMtimes[changed].Add(time.Second))
+	newFile := filepath.Join(root, "cmd", "bar")
+	write(t, newFile, "new binary")
+
+	p := &PersistArtifacts{WorkingDirectory: root}
+	ctx := context.Background()
+
+	artifacts, err := p.discoverArtifacts(ctx, preBuildMtimes)
+	if err != nil {
+		t.Fatalf("discoverArtifacts: unexpected error: %v", err)
+	}
+
+	var got []string
+	for _, a := range artifacts {
+		got = append(got, a.Path)
+	}
+	sort.Strings(got)
+
+	want := []string{changed, newFile}
+	sort.Strings(want)
+
+	if len(got) != len(want) {
+		t.Fatalf("discoverArtifacts() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("discoverArtifacts() = %v, want %v", got, want)
+		}
+	}
+}
+
+func write(t *testing.T, path, contents string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatalf("MkdirAll(%q): %v", filepath.Dir(path), err)
+	}
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatalf("WriteFile(%q): %v", path, err)
+	}
+}
+
+func bumpMtime(t *testing.T, path string, mtime time.Time) {
+	t.Helper()
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatalf("Chtimes(%q): %v", path, err)
+	}
+}